@@ -0,0 +1,55 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+package export
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pingcap/br/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStorage(t *testing.T) storage.ExternalStorage {
+	s, err := storage.NewLocalStorage(t.TempDir())
+	require.NoError(t, err)
+	return s
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+
+	cp, err := LoadCheckpoint(ctx, s, "snapshot-1")
+	require.NoError(t, err)
+	require.Empty(t, cp.Chunks)
+
+	cp.MarkChunkDone("db", "t1", 0, "db.t1.0.sql", 1024)
+	require.True(t, cp.IsChunkDone("db", "t1", 0))
+	require.False(t, cp.IsChunkDone("db", "t1", 1))
+	require.NoError(t, cp.Flush(ctx, s))
+
+	reloaded, err := LoadCheckpoint(ctx, s, "snapshot-1")
+	require.NoError(t, err)
+	require.True(t, reloaded.IsChunkDone("db", "t1", 0))
+	chunk := reloaded.Chunks[chunkKey("db", "t1", 0)]
+	require.Equal(t, "db.t1.0.sql", chunk.FilePath)
+	require.Equal(t, uint64(1024), chunk.FileSize)
+
+	require.NoError(t, ResetCheckpoint(ctx, s))
+	fresh, err := LoadCheckpoint(ctx, s, "snapshot-1")
+	require.NoError(t, err)
+	require.Empty(t, fresh.Chunks)
+}
+
+func TestLoadCheckpointRejectsMismatchedSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+
+	cp, err := LoadCheckpoint(ctx, s, "snapshot-1")
+	require.NoError(t, err)
+	require.NoError(t, cp.Flush(ctx, s))
+
+	_, err = LoadCheckpoint(ctx, s, "snapshot-2")
+	require.Error(t, err)
+}
@@ -5,41 +5,68 @@ package export
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/pingcap/br/pkg/utils"
 	"github.com/pingcap/errors"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/dumpling/v4/log"
 )
 
 const (
-	consistencyTypeAuto     = "auto"
-	consistencyTypeFlush    = "flush"
-	consistencyTypeLock     = "lock"
-	consistencyTypeSnapshot = "snapshot"
-	consistencyTypeNone     = "none"
+	consistencyTypeAuto         = "auto"
+	consistencyTypeFlush        = "flush"
+	consistencyTypeLock         = "lock"
+	consistencyTypeLockPerTable = "lock-per-table"
+	consistencyTypeSnapshot     = "snapshot"
+	consistencyTypeNone         = "none"
 )
 
+// defaultLockTablesConns is the number of worker connections
+// ConsistencyLockDumpingTables shards locking work across when the caller
+// doesn't request a specific count via conf.LockTablesConcurrency.
+const defaultLockTablesConns = 4
+
+// lockWaitTimeout is the per-connection `lock_wait_timeout` used while
+// acquiring read locks, kept short so one blocked table backs off and
+// retries instead of stalling its whole shard.
+const lockWaitTimeout = "1"
+
+const errLockWaitTimeoutCode = "1205" // ER_LOCK_WAIT_TIMEOUT
+
 // NewConsistencyController returns a new consistency controller
 func NewConsistencyController(ctx context.Context, conf *Config, session *sql.DB) (ConsistencyController, error) {
-	conn, err := session.Conn(ctx)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
 	switch conf.Consistency {
 	case consistencyTypeFlush:
+		conn, err := session.Conn(ctx)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 		return &ConsistencyFlushTableWithReadLock{
 			serverType: conf.ServerInfo.ServerType,
 			conn:       conn,
 		}, nil
 	case consistencyTypeLock:
-		return &ConsistencyLockDumpingTables{
-			conn:      conn,
-			allTables: conf.Tables,
-		}, nil
+		return newConsistencyLockDumpingTables(ctx, session, conf.Tables, conf.LockTablesConcurrency)
+	case consistencyTypeLockPerTable:
+		return &ConsistencyLockPerTable{session: session}, nil
 	case consistencyTypeSnapshot:
-		if conf.ServerInfo.ServerType != ServerTypeTiDB {
+		switch conf.ServerInfo.ServerType {
+		case ServerTypeTiDB:
+			return &ConsistencyNone{}, nil
+		case ServerTypeMySQL, ServerTypeMariaDB:
+			conn, err := session.Conn(ctx)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			conf.TransactionalConsistency = true
+			return &ConsistencyTransactionalSnapshot{conn: conn}, nil
+		default:
 			return nil, errors.New("snapshot consistency is not supported for this server")
 		}
-		return &ConsistencyNone{}, nil
 	case consistencyTypeNone:
 		return &ConsistencyNone{}, nil
 	default:
@@ -106,24 +133,331 @@ func (c *ConsistencyFlushTableWithReadLock) PingContext(ctx context.Context) err
 	return c.conn.PingContext(ctx)
 }
 
-// ConsistencyLockDumpingTables execute lock tables read on all tables before dump
+// lockShard is a subset of allTables that a single worker connection in
+// ConsistencyLockDumpingTables is responsible for locking.
+type lockShard struct {
+	conn   *sql.Conn
+	tables DatabaseTables
+}
+
+// ConsistencyLockDumpingTables acquires read locks on every table before the
+// dump, spread across several worker connections so one table that is slow
+// to lock only stalls its own shard instead of the whole dump. Each worker
+// runs with a short `lock_wait_timeout` and backs off exponentially on
+// ER_LOCK_WAIT_TIMEOUT, retrying only the tables it still owns.
 type ConsistencyLockDumpingTables struct {
-	conn      *sql.Conn
-	allTables DatabaseTables
+	shards []*lockShard
+}
+
+// newConsistencyLockDumpingTables opens the worker connections and shards
+// allTables across them, without locking anything yet; locking happens in
+// Setup so retries stay confined to ConsistencyController's lifecycle.
+// concurrency is the number of worker connections to shard locking work
+// across; if zero (conf.LockTablesConcurrency unset), defaultLockTablesConns
+// is used instead.
+func newConsistencyLockDumpingTables(ctx context.Context, session *sql.DB, allTables DatabaseTables, concurrency int) (*ConsistencyLockDumpingTables, error) {
+	numConns := concurrency
+	if numConns <= 0 {
+		numConns = defaultLockTablesConns
+	}
+	shardedTables := shardDatabaseTables(allTables, numConns)
+
+	shards := make([]*lockShard, 0, len(shardedTables))
+	for _, tables := range shardedTables {
+		if len(tables) == 0 {
+			continue
+		}
+		conn, err := session.Conn(ctx)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf("SET SESSION lock_wait_timeout=%s", lockWaitTimeout)); err != nil {
+			conn.Close()
+			return nil, errors.Trace(err)
+		}
+		shards = append(shards, &lockShard{conn: conn, tables: tables})
+	}
+	return &ConsistencyLockDumpingTables{shards: shards}, nil
 }
 
 // Setup implements ConsistencyController.Setup
 func (c *ConsistencyLockDumpingTables) Setup(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(c.shards))
+	for i, shard := range c.shards {
+		wg.Add(1)
+		go func(i int, shard *lockShard) {
+			defer wg.Done()
+			errs[i] = lockShardWithBackoff(ctx, shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockShardWithBackoff retries a shard's LOCK TABLES statement, dropping
+// tables that keep hitting ER_LOCK_WAIT_TIMEOUT into a block list and
+// backing off exponentially, so one stubborn table doesn't spin the retry
+// loop on the whole shard.
+func lockShardWithBackoff(ctx context.Context, shard *lockShard) error {
 	blockList := make(map[string]map[string]interface{})
 	return utils.WithRetry(ctx, func() error {
-		lockTablesSQL := buildLockTablesSQL(c.allTables, blockList)
-		_, err := c.conn.ExecContext(ctx, lockTablesSQL)
+		lockTablesSQL := buildLockTablesSQL(shard.tables, blockList)
+		_, err := shard.conn.ExecContext(ctx, lockTablesSQL)
+		if isLockWaitTimeoutErr(err) {
+			log.Debug("a table is locked by someone else, backing off and retrying the rest of the shard",
+				zap.Int("blockedTables", len(blockList)))
+		}
 		return errors.Trace(err)
 	}, newLockTablesBackoffer(blockList))
 }
 
 // TearDown implements ConsistencyController.TearDown
 func (c *ConsistencyLockDumpingTables) TearDown(ctx context.Context) error {
+	var firstErr error
+	for _, shard := range c.shards {
+		if shard.conn == nil {
+			continue
+		}
+		err := UnlockTables(ctx, shard.conn)
+		shard.conn.Close()
+		shard.conn = nil
+		if err != nil && firstErr == nil {
+			firstErr = errors.Trace(err)
+		}
+	}
+	return firstErr
+}
+
+// PingContext implements ConsistencyController.PingContext
+func (c *ConsistencyLockDumpingTables) PingContext(ctx context.Context) error {
+	for _, shard := range c.shards {
+		if shard.conn == nil {
+			return errors.New("consistency connection has already been closed")
+		}
+		if err := shard.conn.PingContext(ctx); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// shardDatabaseTables splits allTables into n roughly-even shards, each a
+// DatabaseTables holding a subset of the original tables, so they can be
+// locked by independent worker connections.
+func shardDatabaseTables(allTables DatabaseTables, n int) []DatabaseTables {
+	shards := make([]DatabaseTables, n)
+	for i := range shards {
+		shards[i] = make(DatabaseTables)
+	}
+	i := 0
+	for db, tables := range allTables {
+		for _, table := range tables {
+			shard := shards[i%n]
+			shard[db] = append(shard[db], table)
+			i++
+		}
+	}
+	return shards
+}
+
+// isLockWaitTimeoutErr reports whether err is MySQL's ER_LOCK_WAIT_TIMEOUT,
+// the signal that a table is locked by someone else and should be retried
+// rather than treated as fatal.
+func isLockWaitTimeoutErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), errLockWaitTimeoutCode) || strings.Contains(err.Error(), "Lock wait timeout exceeded")
+}
+
+// ConsistencyLockPerTable holds a read lock on each table only while that
+// table is being dumped: acquired right before that table's chunks start and
+// released via Writer.finishTableCallBack once they're done, so a
+// long-running dump never holds the full table set locked for its whole
+// duration. Writers dumping different tables hold their locks at the same
+// time.
+type ConsistencyLockPerTable struct {
+	session *sql.DB
+
+	mu    sync.Mutex
+	locks map[string]*sql.Conn
+}
+
+// Setup implements ConsistencyController.Setup. Locks are acquired lazily
+// per table via LockTable, so Setup has nothing to do upfront.
+func (c *ConsistencyLockPerTable) Setup(_ context.Context) error {
+	c.locks = make(map[string]*sql.Conn)
+	return nil
+}
+
+// LockTable acquires a read lock on a single table. It should be called
+// just before that table's first chunk is dumped.
+func (c *ConsistencyLockPerTable) LockTable(ctx context.Context, db, table string) error {
+	conn, err := c.session.Conn(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("SET SESSION lock_wait_timeout=%s", lockWaitTimeout)); err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+	blockList := make(map[string]map[string]interface{})
+	allTables := DatabaseTables{db: []*TableInfo{{Name: table, Type: TableTypeBase}}}
+	err = utils.WithRetry(ctx, func() error {
+		lockTablesSQL := buildLockTablesSQL(allTables, blockList)
+		_, err := conn.ExecContext(ctx, lockTablesSQL)
+		return errors.Trace(err)
+	}, newLockTablesBackoffer(blockList))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.mu.Lock()
+	c.locks[lockPerTableKey(db, table)] = conn
+	c.mu.Unlock()
+	return nil
+}
+
+// UnlockTable releases the read lock taken by LockTable for a single
+// table. Intended to be driven from Writer.finishTableCallBack once a
+// table's last chunk has been written.
+func (c *ConsistencyLockPerTable) UnlockTable(ctx context.Context, db, table string) error {
+	key := lockPerTableKey(db, table)
+	c.mu.Lock()
+	conn, ok := c.locks[key]
+	delete(c.locks, key)
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	defer conn.Close()
+	return UnlockTables(ctx, conn)
+}
+
+// TearDown implements ConsistencyController.TearDown and unlocks any table
+// whose UnlockTable was never called, e.g. because the dump failed partway
+// through.
+func (c *ConsistencyLockPerTable) TearDown(ctx context.Context) error {
+	c.mu.Lock()
+	locks := c.locks
+	c.locks = nil
+	c.mu.Unlock()
+
+	var firstErr error
+	for _, conn := range locks {
+		if err := UnlockTables(ctx, conn); err != nil && firstErr == nil {
+			firstErr = errors.Trace(err)
+		}
+		conn.Close()
+	}
+	return firstErr
+}
+
+// PingContext implements ConsistencyController.PingContext
+func (c *ConsistencyLockPerTable) PingContext(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.locks {
+		if err := conn.PingContext(ctx); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func lockPerTableKey(db, table string) string {
+	return db + "." + table
+}
+
+// ConsistencyTransactionalSnapshot takes a global read lock (FTWRL), starts
+// a REPEATABLE READ transaction with a consistent snapshot on a dedicated
+// connection while that lock is held, and keeps the lock held until every
+// per-chunk dumping connection has joined the same snapshot via Join — the
+// mysqldump/mydumper trick for taking a consistent dump of non-TiDB
+// MySQL/MariaDB without holding the global lock for the whole run. The lock
+// is only safe to release, via ReleaseLock, once JoinWorkerConnections has
+// returned; a connection that joins after that point would start its own,
+// later snapshot instead of sharing this one.
+type ConsistencyTransactionalSnapshot struct {
+	conn         *sql.Conn
+	snapshotMeta string
+
+	mu       sync.Mutex
+	lockHeld bool
+}
+
+// Setup implements ConsistencyController.Setup. It acquires the global read
+// lock and starts this controller's own consistent-snapshot transaction,
+// but deliberately leaves the lock held — callers must route every
+// per-chunk connection through Join (or JoinWorkerConnections) and then
+// call ReleaseLock, or those connections will not share this snapshot.
+func (c *ConsistencyTransactionalSnapshot) Setup(ctx context.Context) error {
+	if err := FlushTableWithReadLock(ctx, c.conn); err != nil {
+		return errors.Trace(err)
+	}
+	c.mu.Lock()
+	c.lockHeld = true
+	c.mu.Unlock()
+
+	if _, err := c.conn.ExecContext(ctx, "SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := c.conn.ExecContext(ctx, "START TRANSACTION /*!40108 WITH CONSISTENT SNAPSHOT */"); err != nil {
+		return errors.Trace(err)
+	}
+	snapshotMeta, err := getSnapshotPosition(ctx, c.conn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.snapshotMeta = snapshotMeta
+	return nil
+}
+
+// Join makes a per-chunk dumping connection join the snapshot taken by
+// Setup. It fails if the global read lock has already been released via
+// ReleaseLock, since joining at that point could no longer guarantee the
+// connection shares this snapshot's point in time.
+func (c *ConsistencyTransactionalSnapshot) Join(ctx context.Context, conn *sql.Conn) error {
+	c.mu.Lock()
+	held := c.lockHeld
+	c.mu.Unlock()
+	if !held {
+		return errors.New("cannot join consistent snapshot: the global read lock has already been released")
+	}
+	return JoinConsistentSnapshot(ctx, conn)
+}
+
+// JoinWorkerConnections joins every connection in conns to the snapshot
+// taken by Setup, in one call, immediately before calling ReleaseLock.
+func (c *ConsistencyTransactionalSnapshot) JoinWorkerConnections(ctx context.Context, conns []*sql.Conn) error {
+	for _, conn := range conns {
+		if err := c.Join(ctx, conn); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// ReleaseLock releases the global read lock acquired by Setup, letting
+// writes resume. Every connection that needs this snapshot must have
+// already called Join: each one keeps its own frozen MVCC view for the
+// rest of the run even after the lock is gone.
+func (c *ConsistencyTransactionalSnapshot) ReleaseLock(ctx context.Context) error {
+	c.mu.Lock()
+	c.lockHeld = false
+	c.mu.Unlock()
+	return errors.Trace(UnlockTables(ctx, c.conn))
+}
+
+// TearDown implements ConsistencyController.TearDown
+func (c *ConsistencyTransactionalSnapshot) TearDown(ctx context.Context) error {
 	if c.conn == nil {
 		return nil
 	}
@@ -131,15 +465,66 @@ func (c *ConsistencyLockDumpingTables) TearDown(ctx context.Context) error {
 		c.conn.Close()
 		c.conn = nil
 	}()
-	return UnlockTables(ctx, c.conn)
+	_, err := c.conn.ExecContext(ctx, "COMMIT")
+	return errors.Trace(err)
 }
 
 // PingContext implements ConsistencyController.PingContext
-func (c *ConsistencyLockDumpingTables) PingContext(ctx context.Context) error {
+func (c *ConsistencyTransactionalSnapshot) PingContext(ctx context.Context) error {
 	if c.conn == nil {
 		return errors.New("consistency connection has already been closed")
 	}
 	return c.conn.PingContext(ctx)
 }
 
+// JoinConsistentSnapshot makes a connection join the snapshot taken by
+// ConsistencyTransactionalSnapshot.Setup. It must only be called while the
+// global read lock (FTWRL) from that Setup call is still held, before that
+// lock is released — use ConsistencyTransactionalSnapshot.Join, which
+// enforces this, rather than calling it directly.
+func JoinConsistentSnapshot(ctx context.Context, conn *sql.Conn) error {
+	if _, err := conn.ExecContext(ctx, "SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+		return errors.Trace(err)
+	}
+	_, err := conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT")
+	return errors.Trace(err)
+}
+
+// getSnapshotPosition reads back the GTID set (if the server has GTID mode
+// on) or the binlog file/position otherwise. Setup keeps the result in
+// snapshotMeta only; it is not passed to the checkpoint, whose snapshot
+// check uses conf.Snapshot.
+func getSnapshotPosition(ctx context.Context, conn *sql.Conn) (string, error) {
+	var gtidSet sql.NullString
+	row := conn.QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_executed")
+	if err := row.Scan(&gtidSet); err != nil {
+		return "", errors.Trace(err)
+	}
+	if gtidSet.Valid && gtidSet.String != "" {
+		return gtidSet.String, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, "SHOW MASTER STATUS")
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	fields := make([]sql.NullString, len(cols))
+	scanArgs := make([]interface{}, len(cols))
+	for i := range fields {
+		scanArgs[i] = &fields[i]
+	}
+	if rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return "", errors.Trace(err)
+		}
+		return fmt.Sprintf("%s:%s", fields[0].String, fields[snapshotFieldIndex].String), nil
+	}
+	return "", nil
+}
+
 const snapshotFieldIndex = 1
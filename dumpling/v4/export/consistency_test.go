@@ -0,0 +1,54 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+package export
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardDatabaseTables(t *testing.T) {
+	allTables := DatabaseTables{
+		"db1": []*TableInfo{
+			{Name: "t1", Type: TableTypeBase},
+			{Name: "t2", Type: TableTypeBase},
+			{Name: "t3", Type: TableTypeBase},
+		},
+		"db2": []*TableInfo{
+			{Name: "t1", Type: TableTypeBase},
+		},
+	}
+
+	shards := shardDatabaseTables(allTables, 3)
+	require.Len(t, shards, 3)
+
+	total := 0
+	seen := make(map[string]bool)
+	for _, shard := range shards {
+		for db, tables := range shard {
+			for _, table := range tables {
+				total++
+				seen[db+"."+table.Name] = true
+			}
+		}
+	}
+	require.Equal(t, 4, total)
+	require.Len(t, seen, 4)
+}
+
+func TestShardDatabaseTablesEmpty(t *testing.T) {
+	shards := shardDatabaseTables(DatabaseTables{}, 4)
+	require.Len(t, shards, 4)
+	for _, shard := range shards {
+		require.Empty(t, shard)
+	}
+}
+
+func TestIsLockWaitTimeoutErr(t *testing.T) {
+	require.False(t, isLockWaitTimeoutErr(nil))
+	require.False(t, isLockWaitTimeoutErr(errors.New("some other error")))
+	require.True(t, isLockWaitTimeoutErr(errors.New("Error 1205: Lock wait timeout exceeded; try restarting transaction")))
+	require.True(t, isLockWaitTimeoutErr(errors.New("Error 1205 (HY000): something")))
+}
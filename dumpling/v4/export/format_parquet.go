@@ -0,0 +1,359 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+package export
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/br/pkg/storage"
+	"github.com/pingcap/errors"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/schema"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// FileFormatParquet encodes each chunk as a Parquet file instead of SQL
+// INSERT statements or CSV rows, so a dump is directly consumable by
+// Spark/Trino/DuckDB analytics engines without a follow-up conversion step.
+var FileFormatParquet FileFormat = fileFormatParquet{}
+
+type fileFormatParquet struct{}
+
+// Extension implements FileFormat.Extension
+func (fileFormatParquet) Extension() string {
+	return "parquet"
+}
+
+// WriteInsert implements FileFormat.WriteInsert by writing every row into a
+// single file with no file rotation; row groups inside that file are still
+// cut at defaultParquetRowGroupSize. Writer never calls this for
+// Parquet chunks — it dispatches to WriteInsertRotating instead, since a
+// Parquet file's footer cannot be split across a byte-threshold rotation —
+// but fileFormatParquet still has to satisfy FileFormat for anything that
+// uses it as a plain FileFormat.
+func (f fileFormatParquet) WriteInsert(ctx context.Context, cfg *Config, meta TableMeta, ir TableDataIR, w io.Writer) error {
+	sch, err := parquetSchemaOf(meta.ColumnTypes(), meta.ColumnNames())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	pw, err := newRowGroupWriter(asParquetFile(w), sch, UnspecifiedSize)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := writeParquetRows(ctx, ir, meta.ColumnTypes(), pw); err != nil {
+		pw.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(pw.Close())
+}
+
+// WriteInsertRotating implements rotatingFileFormat. Unlike the shared
+// writerPipe, it rotates to a new file (via namer.NextName) only in between
+// rows, once the row group currently being buffered has grown past
+// cfg.FileSize, so the footer written by rowGroupWriter.Close always lands
+// in the same file as the header and row groups it describes.
+func (f fileFormatParquet) WriteInsertRotating(ctx context.Context, cfg *Config, meta TableMeta, ir TableDataIR, extStorage storage.ExternalStorage, namer *outputFileNamer, onFileDone func(fileName string, fileSize uint64)) error {
+	sch, err := parquetSchemaOf(meta.ColumnTypes(), meta.ColumnNames())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	colTypes := meta.ColumnTypes()
+
+	openFile := func() (*rowGroupWriter, string, func(context.Context), error) {
+		fileName, err := namer.NextName(cfg.OutputFileTemplate, f.Extension())
+		if err != nil {
+			return nil, "", nil, errors.Trace(err)
+		}
+		fileWriter, tearDown := buildInterceptFileWriter(extStorage, fileName, cfg.CompressType)
+		pw, err := newRowGroupWriter(asParquetFile(fileWriter), sch, cfg.FileSize)
+		if err != nil {
+			tearDown(ctx)
+			return nil, "", nil, errors.Trace(err)
+		}
+		return pw, fileName, tearDown, nil
+	}
+
+	pw, fileName, tearDown, err := openFile()
+	if err != nil {
+		return err
+	}
+	closeCurrent := func() error {
+		closeErr := pw.Close()
+		tearDown(ctx)
+		if onFileDone != nil {
+			onFileDone(fileName, pw.BytesWritten())
+		}
+		return errors.Trace(closeErr)
+	}
+
+	rows := ir.Rows()
+	defer rows.Close()
+	for rows.HasNext() {
+		row, err := scanParquetRow(rows, colTypes)
+		if err != nil {
+			closeCurrent()
+			return errors.Trace(err)
+		}
+		if err := pw.WriteRow(row); err != nil {
+			closeCurrent()
+			return errors.Trace(err)
+		}
+		if cfg.FileSize != UnspecifiedSize && pw.ShouldRotate() {
+			if err := closeCurrent(); err != nil {
+				return err
+			}
+			if pw, fileName, tearDown, err = openFile(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Error(); err != nil {
+		closeCurrent()
+		return errors.Trace(err)
+	}
+	return closeCurrent()
+}
+
+// writeParquetRows scans every row out of ir and writes it to pw, used by
+// the non-rotating WriteInsert path.
+func writeParquetRows(ctx context.Context, ir TableDataIR, colTypes []*sql.ColumnType, pw *rowGroupWriter) error {
+	rows := ir.Rows()
+	defer rows.Close()
+	for rows.HasNext() {
+		row, err := scanParquetRow(rows, colTypes)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := pw.WriteRow(row); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(rows.Error())
+}
+
+// scanParquetRow reads the next row off rows and converts each column to
+// the Go value the Parquet schema built by parquetSchemaOf expects. Every
+// column is declared OPTIONAL, so a NULL value is represented by a nil
+// pointer rather than a sentinel, which the schema's definition levels then
+// encode as "field absent" instead of a concrete value.
+func scanParquetRow(rows interface{ Scan(dest ...interface{}) error }, colTypes []*sql.ColumnType) (map[string]interface{}, error) {
+	raw := make([]sql.RawBytes, len(colTypes))
+	dest := make([]interface{}, len(colTypes))
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	row := make(map[string]interface{}, len(colTypes))
+	for i, ct := range colTypes {
+		if raw[i] == nil {
+			row[ct.Name()] = parquetNullValueOf(ct.DatabaseTypeName())
+			continue
+		}
+		val, err := parquetValueOf(ct, raw[i])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		row[ct.Name()] = val
+	}
+	return row, nil
+}
+
+// parquetValueOf converts one column's textual value, as returned by the
+// MySQL/TiDB driver, to the pointer type matching its Parquet physical type
+// in parquetTypeOf, so the row's column values are always honored via
+// definition levels rather than raw byte comparisons.
+func parquetValueOf(ct *sql.ColumnType, raw sql.RawBytes) (interface{}, error) {
+	mysqlType := ct.DatabaseTypeName()
+	s := string(raw)
+	switch {
+	case strings.HasPrefix(mysqlType, "TINYINT"),
+		strings.HasPrefix(mysqlType, "SMALLINT"),
+		strings.HasPrefix(mysqlType, "MEDIUMINT"),
+		strings.HasPrefix(mysqlType, "INT"):
+		v, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		r := int32(v)
+		return &r, nil
+	case strings.HasPrefix(mysqlType, "BIGINT"):
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &v, nil
+	case strings.HasPrefix(mysqlType, "FLOAT"), strings.HasPrefix(mysqlType, "DOUBLE"):
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &v, nil
+	case strings.HasPrefix(mysqlType, "DECIMAL"):
+		_, scale, ok := ct.DecimalSize()
+		if !ok {
+			scale = 0
+		}
+		b, err := encodeParquetDecimal(s, scale)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		v := string(b)
+		return &v, nil
+	case mysqlType == "DATE":
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		days := int32(t.Unix() / int64((24 * time.Hour).Seconds()))
+		return &days, nil
+	case mysqlType == "DATETIME", mysqlType == "TIMESTAMP":
+		// DATETIME(N)/TIMESTAMP(N) columns render a fractional-seconds
+		// part the driver's textual value includes verbatim, e.g.
+		// "2024-01-01 10:20:30.123456"; without its own layout clause
+		// time.Parse rejects anything but exactly N=0 digits.
+		layout := "2006-01-02 15:04:05"
+		if i := strings.IndexByte(s, '.'); i >= 0 {
+			layout += "." + strings.Repeat("0", len(s)-i-1)
+		}
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		millis := t.UnixNano() / int64(time.Millisecond)
+		return &millis, nil
+	default:
+		return &s, nil
+	}
+}
+
+// parquetNullValueOf returns the typed nil pointer matching mysqlType's
+// Parquet physical type, so a NULL column always produces the same Go type
+// WriteRow would otherwise see for a non-NULL value of that column.
+func parquetNullValueOf(mysqlType string) interface{} {
+	switch {
+	case strings.HasPrefix(mysqlType, "TINYINT"),
+		strings.HasPrefix(mysqlType, "SMALLINT"),
+		strings.HasPrefix(mysqlType, "MEDIUMINT"),
+		strings.HasPrefix(mysqlType, "INT"):
+		return (*int32)(nil)
+	case strings.HasPrefix(mysqlType, "BIGINT"):
+		return (*int64)(nil)
+	case strings.HasPrefix(mysqlType, "FLOAT"), strings.HasPrefix(mysqlType, "DOUBLE"):
+		return (*float64)(nil)
+	case mysqlType == "DATE":
+		return (*int32)(nil)
+	case mysqlType == "DATETIME", mysqlType == "TIMESTAMP":
+		return (*int64)(nil)
+	default:
+		// DECIMAL and the BYTE_ARRAY/UTF8 fallback are both stored as string.
+		return (*string)(nil)
+	}
+}
+
+// encodeParquetDecimal converts a decimal literal such as "-123.45" into
+// the big-endian two's-complement unscaled-integer byte representation the
+// Parquet DECIMAL converted type requires, scaled to exactly `scale`
+// digits after the decimal point to match the SchemaElement.Scale written
+// by parquetSchemaElementOf.
+func encodeParquetDecimal(s string, scale int64) ([]byte, error) {
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	for int64(len(fracPart)) < scale {
+		fracPart += "0"
+	}
+	fracPart = fracPart[:scale]
+
+	unscaled, ok := new(big.Int).SetString(intPart+fracPart, 10)
+	if !ok {
+		return nil, errors.Errorf("invalid decimal literal %q", s)
+	}
+	if neg {
+		unscaled.Neg(unscaled)
+	}
+
+	if unscaled.Sign() >= 0 {
+		b := unscaled.Bytes()
+		if len(b) == 0 {
+			return []byte{0}, nil
+		}
+		if b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		return b, nil
+	}
+	bitLen := unscaled.BitLen() + 1 // +1 so the sign bit itself has room
+	numBytes := (bitLen + 7) / 8
+	mod := new(big.Int).Lsh(big.NewInt(1), uint(numBytes*8))
+	twosComplement := mod.Add(mod, unscaled)
+	b := twosComplement.Bytes()
+	for len(b) < numBytes {
+		b = append([]byte{0}, b...)
+	}
+	return b, nil
+}
+
+// rowGroupWriter wraps a parquet writer.ParquetWriter, rotating to a new
+// file (via the caller's openFile, not a new row group in the same file)
+// once the row group being buffered has grown past its size limit, so
+// every output file stays a single, independently valid Parquet file with
+// its own header, row group(s), and footer.
+type rowGroupWriter struct {
+	pw            *writer.ParquetWriter
+	fileSizeLimit int64
+}
+
+func newRowGroupWriter(pf source.ParquetFile, sch *schema.SchemaHandler, fileSizeLimit uint64) (*rowGroupWriter, error) {
+	pw, err := writer.NewParquetWriter(pf, nil, 1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pw.SchemaHandler = sch
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+
+	limit := int64(defaultParquetRowGroupSize)
+	if fileSizeLimit != UnspecifiedSize {
+		limit = int64(fileSizeLimit)
+	}
+	pw.RowGroupSize = limit
+	return &rowGroupWriter{pw: pw, fileSizeLimit: limit}, nil
+}
+
+func (r *rowGroupWriter) WriteRow(row interface{}) error {
+	return errors.Trace(r.pw.Write(row))
+}
+
+// ShouldRotate reports whether the row group currently being buffered has
+// grown past the file size limit, so the caller should close this file and
+// open a new one before writing the next row.
+func (r *rowGroupWriter) ShouldRotate() bool {
+	return r.pw.Size >= r.fileSizeLimit
+}
+
+// BytesWritten returns the number of (uncompressed) bytes buffered into the
+// current row group so far.
+func (r *rowGroupWriter) BytesWritten() uint64 {
+	return uint64(r.pw.Size)
+}
+
+func (r *rowGroupWriter) Close() error {
+	return errors.Trace(r.pw.WriteStop())
+}
+
+// defaultParquetRowGroupSize is used when conf.FileSize is unspecified.
+const defaultParquetRowGroupSize = 128 * 1024 * 1024 // 128 MiB
@@ -0,0 +1,126 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+package export
+
+import (
+	"database/sql"
+	"io"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/schema"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// parquetSchemaOf maps a table's MySQL/TiDB column types to a Parquet
+// schema. Every column is declared OPTIONAL (definition level 1) so a NULL
+// value can be represented without a sentinel, matching SQL semantics.
+func parquetSchemaOf(colTypes []*sql.ColumnType, colNames []string) (*schema.SchemaHandler, error) {
+	elems := make([]*parquet.SchemaElement, 0, len(colTypes)+1)
+	repType := parquet.FieldRepetitionType_OPTIONAL
+
+	root := "Msg"
+	numChildren := int32(len(colTypes))
+	elems = append(elems, &parquet.SchemaElement{
+		Name:           root,
+		NumChildren:    &numChildren,
+		RepetitionType: nil,
+	})
+
+	for i, ct := range colTypes {
+		elem, err := parquetSchemaElementOf(colNames[i], ct)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		elem.RepetitionType = &repType
+		elems = append(elems, elem)
+	}
+	return schema.NewSchemaHandlerFromSchemaList(elems), nil
+}
+
+// parquetSchemaElementOf maps one MySQL/TiDB column type to the Parquet
+// logical type it is stored as.
+func parquetSchemaElementOf(name string, ct *sql.ColumnType) (*parquet.SchemaElement, error) {
+	physical, converted := parquetTypeOf(ct.DatabaseTypeName())
+	elem := &parquet.SchemaElement{
+		Type:          &physical,
+		ConvertedType: converted,
+		Name:          name,
+	}
+	if converted != nil && *converted == parquet.ConvertedType_DECIMAL {
+		precision, scale, ok := ct.DecimalSize()
+		if !ok {
+			return nil, errors.Errorf("column %q is DECIMAL but the driver did not report its precision/scale", name)
+		}
+		p, s := int32(precision), int32(scale)
+		elem.Precision = &p
+		elem.Scale = &s
+	}
+	return elem, nil
+}
+
+// parquetTypeOf maps a MySQL/TiDB DatabaseTypeName to the physical and
+// (optionally) converted Parquet type used to store it.
+func parquetTypeOf(mysqlType string) (parquet.Type, *parquet.ConvertedType) {
+	utf8 := parquet.ConvertedType_UTF8
+	decimal := parquet.ConvertedType_DECIMAL
+	tsMillis := parquet.ConvertedType_TIMESTAMP_MILLIS
+	date := parquet.ConvertedType_DATE
+
+	switch {
+	case strings.HasPrefix(mysqlType, "TINYINT"),
+		strings.HasPrefix(mysqlType, "SMALLINT"),
+		strings.HasPrefix(mysqlType, "MEDIUMINT"),
+		strings.HasPrefix(mysqlType, "INT"):
+		return parquet.Type_INT32, nil
+	case strings.HasPrefix(mysqlType, "BIGINT"):
+		return parquet.Type_INT64, nil
+	case strings.HasPrefix(mysqlType, "FLOAT"), strings.HasPrefix(mysqlType, "DOUBLE"):
+		return parquet.Type_DOUBLE, nil
+	case strings.HasPrefix(mysqlType, "DECIMAL"):
+		return parquet.Type_BYTE_ARRAY, &decimal
+	case mysqlType == "DATE":
+		return parquet.Type_INT32, &date
+	case mysqlType == "DATETIME", mysqlType == "TIMESTAMP":
+		return parquet.Type_INT64, &tsMillis
+	default:
+		// CHAR/VARCHAR/TEXT/BLOB/JSON/ENUM/SET and anything else we don't
+		// special-case fall back to a plain UTF-8 byte array.
+		return parquet.Type_BYTE_ARRAY, &utf8
+	}
+}
+
+// asParquetFile adapts a sequential io.Writer (the writer handed to
+// fileFormatParquet.WriteInsert, or the file writer WriteInsertRotating opens
+// for each output file; Parquet never goes through a writerPipe) to the
+// source.ParquetFile interface the parquet-go writer expects. Parquet files are written
+// strictly forward (footer last), so Seek is a no-op as long as the caller
+// never seeks backwards, which writer.ParquetWriter does not.
+type asParquetFileWriter struct {
+	io.Writer
+}
+
+func asParquetFile(w io.Writer) source.ParquetFile {
+	return &asParquetFileWriter{Writer: w}
+}
+
+func (f *asParquetFileWriter) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (f *asParquetFileWriter) Read(p []byte) (int, error) {
+	return 0, errors.New("asParquetFileWriter does not support reading back a streamed dump")
+}
+
+func (f *asParquetFileWriter) Close() error {
+	return nil
+}
+
+func (f *asParquetFileWriter) Open(name string) (source.ParquetFile, error) {
+	return nil, errors.Errorf("asParquetFileWriter does not support opening %q", name)
+}
+
+func (f *asParquetFileWriter) Create(name string) (source.ParquetFile, error) {
+	return nil, errors.Errorf("asParquetFileWriter does not support creating %q", name)
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+package export
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+func TestParquetTypeOf(t *testing.T) {
+	cases := []struct {
+		mysqlType string
+		physical  parquet.Type
+		converted *parquet.ConvertedType
+	}{
+		{"INT", parquet.Type_INT32, nil},
+		{"BIGINT", parquet.Type_INT64, nil},
+		{"DOUBLE", parquet.Type_DOUBLE, nil},
+	}
+	for _, c := range cases {
+		physical, converted := parquetTypeOf(c.mysqlType)
+		require.Equal(t, c.physical, physical, c.mysqlType)
+		if c.converted == nil {
+			require.Nil(t, converted, c.mysqlType)
+		}
+	}
+
+	physical, converted := parquetTypeOf("DECIMAL")
+	require.Equal(t, parquet.Type_BYTE_ARRAY, physical)
+	require.NotNil(t, converted)
+	require.Equal(t, parquet.ConvertedType_DECIMAL, *converted)
+
+	physical, converted = parquetTypeOf("VARCHAR")
+	require.Equal(t, parquet.Type_BYTE_ARRAY, physical)
+	require.NotNil(t, converted)
+	require.Equal(t, parquet.ConvertedType_UTF8, *converted)
+}
+
+func TestEncodeParquetDecimalRoundTrips(t *testing.T) {
+	cases := []struct {
+		literal string
+		scale   int64
+		want    int64 // decoded back as a plain integer for small values
+	}{
+		{"123.45", 2, 12345},
+		{"-123.45", 2, -12345},
+		{"0.00", 2, 0},
+		{"7", 0, 7},
+		{"-7", 0, -7},
+	}
+	for _, c := range cases {
+		b, err := encodeParquetDecimal(c.literal, c.scale)
+		require.NoError(t, err, c.literal)
+
+		// decode the big-endian two's-complement bytes back to an int64
+		var v int64
+		neg := len(b) > 0 && b[0]&0x80 != 0
+		for _, by := range b {
+			v = v<<8 | int64(by)
+		}
+		if neg {
+			v -= int64(1) << uint(8*len(b))
+		}
+		require.Equal(t, c.want, v, c.literal)
+	}
+
+	_, err := encodeParquetDecimal("not-a-number", 2)
+	require.Error(t, err)
+}
@@ -7,11 +7,15 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/pingcap/br/pkg/storage"
 	"github.com/pingcap/br/pkg/utils"
+	"github.com/pingcap/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
 	"github.com/pingcap/dumpling/v4/log"
@@ -30,9 +34,36 @@ type Writer struct {
 	rebuildConnFn       func(*sql.Conn) (*sql.Conn, error)
 	finishTaskCallBack  func(Task)
 	finishTableCallBack func(Task)
+
+	checkpoint *Checkpoint
+
+	// snapshotCtl, when set, is the controller whose consistent snapshot
+	// conn must join before w starts dumping any chunk. It is nil whenever
+	// conf.Consistency isn't "snapshot", or on TiDB where the snapshot is
+	// taken by reading as of a TSO instead.
+	snapshotCtl *ConsistencyTransactionalSnapshot
+
+	// lockPerTableCtl, when set, is the controller w must acquire a read
+	// lock from before dumping a table's first chunk, and release once the
+	// table's last chunk is done. It is non-nil only when
+	// conf.Consistency is "lock-per-table".
+	lockPerTableCtl *ConsistencyLockPerTable
+
+	// lastChunkFilePath/lastChunkFileSize record where the most recently
+	// written chunk ended up, so handleTask can pass them to the checkpoint.
+	lastChunkFilePath string
+	lastChunkFileSize uint64
 }
 
-func NewWriter(id int64, ctx context.Context, config *Config, conn *sql.Conn, externalStore storage.ExternalStorage) *Writer {
+// NewWriter constructs a Writer around conn. If snapshotCtl is non-nil, conn
+// is joined to its consistent snapshot before NewWriter returns — the
+// global read lock snapshotCtl.Setup took must still be held at this point,
+// i.e. every Writer needs to be constructed (and thus joined) before the
+// caller releases that lock with snapshotCtl.ReleaseLock. If lockPerTableCtl
+// is non-nil, w locks and unlocks each table it dumps through it, and the
+// caller must not also set a finishTableCallBack, since NewWriter installs
+// one itself to release the lock.
+func NewWriter(id int64, ctx context.Context, config *Config, conn *sql.Conn, externalStore storage.ExternalStorage, snapshotCtl *ConsistencyTransactionalSnapshot, lockPerTableCtl *ConsistencyLockPerTable) (*Writer, error) {
 	sw := &Writer{
 		id:                  id,
 		ctx:                 ctx,
@@ -41,14 +72,43 @@ func NewWriter(id int64, ctx context.Context, config *Config, conn *sql.Conn, ex
 		extStorage:          externalStore,
 		finishTaskCallBack:  func(Task) {},
 		finishTableCallBack: func(Task) {},
+		snapshotCtl:         snapshotCtl,
+		lockPerTableCtl:     lockPerTableCtl,
 	}
 	switch strings.ToLower(config.FileType) {
 	case "sql":
 		sw.fileFmt = FileFormatSQLText
 	case "csv":
 		sw.fileFmt = FileFormatCSV
+	case "parquet":
+		sw.fileFmt = FileFormatParquet
 	}
-	return sw
+	if config.UseCheckpoint {
+		checkpoint, err := LoadCheckpoint(ctx, externalStore, config.Snapshot)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		sw.setCheckpoint(checkpoint)
+	}
+	if snapshotCtl != nil {
+		if err := snapshotCtl.Join(ctx, conn); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if lockPerTableCtl != nil {
+		sw.finishTableCallBack = func(task Task) {
+			t, ok := task.(*TaskTableData)
+			if !ok {
+				return
+			}
+			db, table := t.Meta.DatabaseName(), t.Meta.TableName()
+			if err := lockPerTableCtl.UnlockTable(ctx, db, table); err != nil {
+				log.Warn("failed to unlock table after dumping its last chunk",
+					zap.String("db", db), zap.String("table", table), zap.Error(err))
+			}
+		}
+	}
+	return sw, nil
 }
 
 func (w *Writer) setFinishTaskCallBack(fn func(Task)) {
@@ -56,7 +116,11 @@ func (w *Writer) setFinishTaskCallBack(fn func(Task)) {
 }
 
 func (w *Writer) setFinishTableCallBack(fn func(Task)) {
-	w.finishTaskCallBack = fn
+	w.finishTableCallBack = fn
+}
+
+func (w *Writer) setCheckpoint(checkpoint *Checkpoint) {
+	w.checkpoint = checkpoint
 }
 
 func countTotalTask(writers []*Writer) int {
@@ -97,9 +161,26 @@ func (w *Writer) handleTask(task Task) error {
 	case *TaskViewMeta:
 		return w.WriteViewMeta(t.DatabaseName, t.ViewName, t.CreateTableSQL, t.CreateViewSQL)
 	case *TaskTableData:
-		err := w.WriteTableData(t.Meta, t.Data, t.ChunkIndex)
-		if err != nil {
-			return err
+		db, table := t.Meta.DatabaseName(), t.Meta.TableName()
+		if w.lockPerTableCtl != nil && t.ChunkIndex == 0 {
+			if err := w.lockPerTableCtl.LockTable(w.ctx, db, table); err != nil {
+				return err
+			}
+		}
+		if w.checkpoint != nil && w.checkpoint.IsChunkDone(db, table, t.ChunkIndex) {
+			log.Info("skip chunk already recorded in checkpoint", zap.String("db", db),
+				zap.String("table", table), zap.Int("chunkIndex", t.ChunkIndex))
+		} else {
+			err := w.WriteTableData(t.Meta, t.Data, t.ChunkIndex)
+			if err != nil {
+				return err
+			}
+			if w.checkpoint != nil {
+				w.checkpoint.MarkChunkDone(db, table, t.ChunkIndex, w.lastChunkFilePath, w.lastChunkFileSize)
+				if err := w.checkpoint.Flush(w.ctx, w.extStorage); err != nil {
+					return err
+				}
+			}
 		}
 		if t.ChunkIndex+1 == t.TotalChunks {
 			w.finishTableCallBack(task)
@@ -117,7 +198,7 @@ func (w *Writer) WriteDatabaseMeta(db, createSQL string) error {
 	if err != nil {
 		return err
 	}
-	return writeMetaToFile(ctx, db, createSQL, w.extStorage, fileName+".sql", conf.CompressType)
+	return writeMetaToFile(ctx, db, createSQL, w.extStorage, fileName+".sql", conf.CompressType, w.metaSpecCmts())
 }
 
 func (w *Writer) WriteTableMeta(db, table, createSQL string) error {
@@ -126,7 +207,7 @@ func (w *Writer) WriteTableMeta(db, table, createSQL string) error {
 	if err != nil {
 		return err
 	}
-	return writeMetaToFile(ctx, db, createSQL, w.extStorage, fileName+".sql", conf.CompressType)
+	return writeMetaToFile(ctx, db, createSQL, w.extStorage, fileName+".sql", conf.CompressType, w.metaSpecCmts())
 }
 
 func (w *Writer) WriteViewMeta(db, view, createTableSQL, createViewSQL string) error {
@@ -139,11 +220,22 @@ func (w *Writer) WriteViewMeta(db, view, createTableSQL, createViewSQL string) e
 	if err != nil {
 		return err
 	}
-	err = writeMetaToFile(ctx, db, createTableSQL, w.extStorage, fileNameTable+".sql", conf.CompressType)
+	err = writeMetaToFile(ctx, db, createTableSQL, w.extStorage, fileNameTable+".sql", conf.CompressType, w.metaSpecCmts())
 	if err != nil {
 		return err
 	}
-	return writeMetaToFile(ctx, db, createViewSQL, w.extStorage, fileNameView+".sql", conf.CompressType)
+	return writeMetaToFile(ctx, db, createViewSQL, w.extStorage, fileNameView+".sql", conf.CompressType, w.metaSpecCmts())
+}
+
+// metaSpecCmts returns the SQL-client directives to prepend to a .sql meta
+// file. Parquet tables' row data isn't read back in through a SQL client, so
+// the "/*!40101 SET NAMES binary*/;" hint that tells one how to interpret the
+// CREATE TABLE statement's character encoding doesn't apply.
+func (w *Writer) metaSpecCmts() []string {
+	if strings.ToLower(w.conf.FileType) == "parquet" {
+		return nil
+	}
+	return []string{"/*!40101 SET NAMES binary*/;"}
 }
 
 func (w *Writer) WriteTableData(meta TableMeta, ir TableDataIR, currentChunk int) error {
@@ -161,6 +253,18 @@ func (w *Writer) WriteTableData(meta TableMeta, ir TableDataIR, currentChunk int
 		log.Debug("trying to dump table chunk", zap.Int("retryTime", retryTime), zap.String("db", meta.DatabaseName()),
 			zap.String("table", meta.TableName()), zap.Int("chunkIndex", currentChunk), zap.NamedError("lastError", lastErr))
 		if retryTime > 1 {
+			if w.snapshotCtl != nil {
+				// By the time a connection needs rebuilding, the global read
+				// lock snapshotCtl.Setup took has long since been released,
+				// so there is no way for a new connection to join the
+				// original point-in-time snapshot — only to start a later,
+				// different one. Silently reconnecting here would dump the
+				// rest of this chunk from a different snapshot than the
+				// rest of the run without any indication of that happening.
+				err = errors.New("lost connection while dumping under snapshot consistency; " +
+					"a rebuilt connection cannot rejoin the original consistent snapshot")
+				return
+			}
 			conn, err = w.rebuildConnFn(conn)
 			if err != nil {
 				return
@@ -175,38 +279,234 @@ func (w *Writer) WriteTableData(meta TableMeta, ir TableDataIR, currentChunk int
 	}, newDumpChunkBackoffer(canRebuildConn(conf.Consistency, conf.TransactionalConsistency)))
 }
 
+// rotatingFileFormat is implemented by file formats whose on-disk layout
+// cannot tolerate being split at an arbitrary byte offset (e.g. Parquet's
+// header/row-groups/footer) and therefore must own their file-rotation
+// policy instead of reusing writerPipe's byte-threshold rotation.
+type rotatingFileFormat interface {
+	// WriteInsertRotating writes ir's rows across one or more files named
+	// via namer, rotating to a new file at its own format-appropriate
+	// boundaries. onFileDone is called after each file is finalized with
+	// its name and final size, so the caller can record the last one for
+	// checkpointing.
+	WriteInsertRotating(ctx context.Context, cfg *Config, meta TableMeta, ir TableDataIR, extStorage storage.ExternalStorage, namer *outputFileNamer, onFileDone func(fileName string, fileSize uint64)) error
+}
+
 func (w *Writer) writeTableData(ctx context.Context, meta TableMeta, ir TableDataIR, curChkIdx int) error {
 	conf, format := w.conf, w.fileFmt
 	namer := newOutputFileNamer(meta, curChkIdx, conf.Rows != UnspecifiedSize, conf.FileSize != UnspecifiedSize)
-	fileName, err := namer.NextName(conf.OutputFileTemplate, w.fileFmt.Extension())
+
+	if rf, ok := format.(rotatingFileFormat); ok {
+		return rf.WriteInsertRotating(ctx, conf, meta, ir, w.extStorage, namer, func(fileName string, fileSize uint64) {
+			w.lastChunkFilePath = fileName
+			w.lastChunkFileSize = fileSize
+		})
+	}
+
+	fileName, err := namer.NextName(conf.OutputFileTemplate, format.Extension())
 	if err != nil {
 		return err
 	}
+	fileWriter, tearDown := buildInterceptFileWriter(w.extStorage, fileName, conf.CompressType)
 
-	for {
-		fileWriter, tearDown := buildInterceptFileWriter(w.extStorage, fileName, conf.CompressType)
-		err = format.WriteInsert(ctx, conf, meta, ir, fileWriter)
-		tearDown(ctx)
-		if err != nil {
-			return err
+	var stmtPrefix []byte
+	if strings.ToLower(conf.FileType) == "sql" {
+		stmtPrefix = []byte(fmt.Sprintf("INSERT INTO `%s` VALUES\n", meta.TableName()))
+	}
+	pipe := newWriterPipe(fileWriter, tearDown, fileName, conf.FileSize, conf.StatementSize, conf.Labels, stmtPrefix)
+	go pipe.Run(ctx, func() (storage.ExternalFileWriter, func(context.Context), string, error) {
+		fileName, nameErr := namer.NextName(conf.OutputFileTemplate, format.Extension())
+		if nameErr != nil {
+			return nil, nil, "", nameErr
 		}
+		fw, td := buildInterceptFileWriter(w.extStorage, fileName, conf.CompressType)
+		return fw, td, fileName, nil
+	})
 
-		if w, ok := fileWriter.(*InterceptFileWriter); ok && !w.SomethingIsWritten {
-			break
+	err = format.WriteInsert(ctx, conf, meta, ir, pipe)
+	closeErr := pipe.Close(ctx)
+	w.lastChunkFilePath = pipe.lastFileName
+	w.lastChunkFileSize = pipe.currentFileSize
+	// closeErr carries the real upload failure, if any; err is usually just
+	// the producer-side symptom of that failure (io.ErrClosedPipe), which is
+	// far less useful for debugging, so prefer closeErr when it is set.
+	if closeErr != nil {
+		return closeErr
+	}
+	return err
+}
+
+// writerPipe decouples the serialization of a chunk (format.WriteInsert,
+// which may block on CPU-bound encoding) from uploading it to external
+// storage (which may block on network I/O), so the two can overlap instead
+// of running strictly one after another. Serialized statements are copied
+// into pooled *bytes.Buffer values and handed across a bounded channel to a
+// dedicated consumer goroutine that owns the ExternalFileWriter.
+type writerPipe struct {
+	input  chan *bytes.Buffer
+	errCh  chan error
+	closed chan struct{}
+
+	bufferPool *sync.Pool
+
+	currentFileSize      uint64
+	currentStatementSize uint64
+	finishedFileSize     uint64
+
+	fileSizeLimit      uint64
+	statementSizeLimit uint64
+
+	// stmtPrefix is the "INSERT INTO ... VALUES" prefix to reopen a
+	// statement with after ShouldSwitchStatement trips; nil for formats
+	// (CSV, Parquet) that have no notion of a SQL statement to split.
+	stmtPrefix []byte
+
+	w            storage.ExternalFileWriter
+	tearDown     func(context.Context)
+	lastFileName string
+	labels       prometheus.Labels
+}
+
+var writerPipeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+func newWriterPipe(w storage.ExternalFileWriter, tearDown func(context.Context), fileName string, fileSizeLimit, statementSizeLimit uint64, labels prometheus.Labels, stmtPrefix []byte) *writerPipe {
+	return &writerPipe{
+		input:  make(chan *bytes.Buffer, 8),
+		errCh:  make(chan error, 1),
+		closed: make(chan struct{}),
+
+		bufferPool: &writerPipeBufferPool,
+
+		fileSizeLimit:      fileSizeLimit,
+		statementSizeLimit: statementSizeLimit,
+		stmtPrefix:         stmtPrefix,
+
+		w:            w,
+		tearDown:     tearDown,
+		lastFileName: fileName,
+		labels:       labels,
+	}
+}
+
+// ShouldSwitchStatement reports whether the in-progress INSERT has grown
+// past the per-statement size limit, so the next Write should close it
+// with a ';' and begin a new "INSERT INTO ... VALUES" statement without
+// rotating the output file.
+func (b *writerPipe) ShouldSwitchStatement() bool {
+	return b.statementSizeLimit != UnspecifiedSize && b.currentStatementSize >= b.statementSizeLimit
+}
+
+// ShouldSwitchFile reports whether the current output file has grown past
+// the per-file size limit, so Run should rotate to a new file before
+// writing the next buffer.
+func (b *writerPipe) ShouldSwitchFile() bool {
+	return b.fileSizeLimit != UnspecifiedSize && b.currentFileSize >= b.fileSizeLimit
+}
+
+// Write implements io.Writer. format.WriteInsert writes each serialized row
+// through it. When a stmtPrefix is set and the in-progress statement has
+// grown past the per-statement size limit, Write first closes it with a
+// ';' and reopens a new "INSERT INTO ... VALUES" statement, then forwards
+// p to the consumer goroutine in a pooled buffer.
+func (b *writerPipe) Write(p []byte) (int, error) {
+	if b.stmtPrefix != nil && b.currentStatementSize > 0 && b.ShouldSwitchStatement() {
+		if err := b.send([]byte(";\n")); err != nil {
+			return 0, err
+		}
+		b.FlushStatement()
+		if err := b.send(b.stmtPrefix); err != nil {
+			return 0, err
 		}
+	}
+	if err := b.send(p); err != nil {
+		return 0, err
+	}
+	b.currentStatementSize += uint64(len(p))
+	return len(p), nil
+}
+
+// send copies p into a pooled buffer and hands it to the consumer
+// goroutine, blocking until there is room in the channel or the pipe has
+// been torn down by a failed upload.
+func (b *writerPipe) send(p []byte) error {
+	buf := b.bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if _, err := buf.Write(p); err != nil {
+		b.bufferPool.Put(buf)
+		return errors.Trace(err)
+	}
+	select {
+	case b.input <- buf:
+		return nil
+	case <-b.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+// FlushStatement restarts the per-statement counter once the in-progress
+// INSERT has been closed with a ';'. The per-file counter is kept by Run
+// from the bytes it actually writes.
+func (b *writerPipe) FlushStatement() {
+	b.currentStatementSize = 0
+}
 
-		if conf.FileSize == UnspecifiedSize {
-			break
+// Close signals the consumer goroutine that no more statements are coming
+// and waits for it to drain the channel, report any upload error, and
+// close the last ExternalFileWriter.
+func (b *writerPipe) Close(ctx context.Context) error {
+	close(b.input)
+	select {
+	case err := <-b.errCh:
+		return err
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	}
+}
+
+// Run is the consumer goroutine: it drains serialized buffers off the pipe
+// and writes them to the current ExternalFileWriter, rotating to the next
+// file via nextFile whenever ShouldSwitchFile trips. The file handed to it
+// at construction is torn down here too, as soon as writing moves past it,
+// so no output file stays open longer than the chunk actually needs it.
+func (b *writerPipe) Run(ctx context.Context, nextFile func() (storage.ExternalFileWriter, func(context.Context), string, error)) {
+	defer close(b.closed)
+	for buf := range b.input {
+		if b.ShouldSwitchFile() {
+			if b.tearDown != nil {
+				b.tearDown(ctx)
+			}
+			w, td, fileName, err := nextFile()
+			if err != nil {
+				b.bufferPool.Put(buf)
+				b.errCh <- errors.Trace(err)
+				return
+			}
+			b.w, b.tearDown, b.lastFileName = w, td, fileName
+			b.finishedFileSize += b.currentFileSize
+			b.currentFileSize = 0
 		}
-		fileName, err = namer.NextName(conf.OutputFileTemplate, w.fileFmt.Extension())
+		n := buf.Len()
+		_, err := b.w.Write(ctx, buf.Bytes())
+		buf.Reset()
+		b.bufferPool.Put(buf)
 		if err != nil {
-			return err
+			b.errCh <- errors.Trace(err)
+			return
 		}
+		writeSizeCounter.With(b.labels).Add(float64(n))
+		b.currentFileSize += uint64(n)
+	}
+	if b.tearDown != nil {
+		b.tearDown(ctx)
 	}
-	return nil
+	b.errCh <- nil
 }
 
-func writeMetaToFile(ctx context.Context, target, metaSQL string, s storage.ExternalStorage, path string, compressType storage.CompressType) error {
+func writeMetaToFile(ctx context.Context, target, metaSQL string, s storage.ExternalStorage, path string, compressType storage.CompressType, specCmts []string) error {
 	fileWriter, tearDown, err := buildFileWriter(ctx, s, path, compressType)
 	if err != nil {
 		return err
@@ -214,11 +514,9 @@ func writeMetaToFile(ctx context.Context, target, metaSQL string, s storage.Exte
 	defer tearDown(ctx)
 
 	return WriteMeta(ctx, &metaData{
-		target:  target,
-		metaSQL: metaSQL,
-		specCmts: []string{
-			"/*!40101 SET NAMES binary*/;",
-		},
+		target:   target,
+		metaSQL:  metaSQL,
+		specCmts: specCmts,
 	}, fileWriter)
 }
 